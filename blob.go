@@ -15,13 +15,13 @@ import (
 	"sync/atomic"
 	"unsafe"
 
-	"github.com/ncw/directio"
 	"github.com/pingcap/badger/epoch"
 	"github.com/pingcap/badger/fileutil"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 const blobFileSuffix = ".blob"
@@ -140,13 +140,13 @@ type blobFileBuilder struct {
 	writer *fileutil.DirectWriter
 }
 
-func newBlobFileBuilder(fid uint32, dir string, writeBufferSize int) (*blobFileBuilder, error) {
+func newBlobFileBuilder(fid uint32, dir string, writeBufferSize int, disableDirectIO bool, limiter *rate.Limiter) (*blobFileBuilder, error) {
 	fileName := newBlobFileName(fid, dir)
-	file, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
+	file, err := fileutil.OpenDirectFile(fileName, os.O_CREATE|os.O_RDWR, 0666, disableDirectIO)
 	if err != nil {
 		return nil, err
 	}
-	writer := fileutil.NewDirectWriter(file, writeBufferSize, nil)
+	writer := fileutil.NewDirectWriter(file, writeBufferSize, limiter)
 	// Write 4 bytes 0 header.
 	err = writer.Append(make([]byte, 4))
 	if err != nil {
@@ -584,7 +584,7 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 	})
 	newFid := h.bm.allocFileID()
 	fileName := newBlobFileName(newFid, h.bm.kv.opt.Dir)
-	file, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
+	file, err := fileutil.OpenDirectFile(fileName, os.O_CREATE|os.O_RDWR, 0666, h.bm.kv.opt.DisableDirectIO)
 	if err != nil {
 		return err
 	}
@@ -25,12 +25,14 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/log"
+	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
 
@@ -232,6 +234,10 @@ type CompactDef struct {
 	AllocIDFunc func() uint64
 	Limiter     *rate.Limiter
 	InMemory    bool
+	// DisableDirectIO opens the output files without O_DIRECT.
+	DisableDirectIO bool
+	// RetainLatestVersionOnly discards all but the latest version of each key regardless of SafeTS.
+	RetainLatestVersionOnly bool
 
 	splitHints []y.Key
 
@@ -500,9 +506,9 @@ func (c *localCompactor) compact(cd *CompactDef, stats *y.CompactionStats, disca
 }
 
 type remoteCompactor struct {
-	remoteAddr string
-	allFiles   []*os.File
-	req        *CompactionReq
+	remoteAddrs []string
+	allFiles    []*os.File
+	req         *CompactionReq
 }
 
 type CompactionReq struct {
@@ -512,6 +518,8 @@ type CompactionReq struct {
 	FileSizes    []int64 `json:"file_sizes"`
 	SafeTS       uint64  `json:"safe_ts"`
 	MaxTableSize int64   `json:"max_table_size"`
+
+	RetainLatestVersionOnly bool `json:"retain_latest_version_only"`
 }
 
 type CompactionResp struct {
@@ -523,6 +531,12 @@ type CompactionResp struct {
 }
 
 func (rc *remoteCompactor) compact(cd *CompactDef, stats *y.CompactionStats, discardStats *DiscardStats) ([]*sstable.BuildResult, error) {
+	conn, err := rc.dial()
+	if err != nil {
+		log.Warn("no remote compaction worker available, compact locally", zap.Error(err))
+		return CompactTables(cd, stats, discardStats)
+	}
+	defer conn.Close()
 	defer rc.cleanup()
 	rc.req = &CompactionReq{
 		Level:        cd.Level,
@@ -530,8 +544,10 @@ func (rc *remoteCompactor) compact(cd *CompactDef, stats *y.CompactionStats, dis
 		NumTop:       len(cd.Top),
 		SafeTS:       cd.SafeTS,
 		MaxTableSize: cd.Opt.MaxTableSize,
+
+		RetainLatestVersionOnly: cd.RetainLatestVersionOnly,
 	}
-	err := rc.appendFiles(cd.Top)
+	err = rc.appendFiles(cd.Top)
 	if err != nil {
 		return nil, err
 	}
@@ -539,11 +555,6 @@ func (rc *remoteCompactor) compact(cd *CompactDef, stats *y.CompactionStats, dis
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.Dial("tcp", rc.remoteAddr)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
 	err = writeJSON(conn, rc.req)
 	if err != nil {
 		return nil, err
@@ -582,6 +593,22 @@ func (rc *remoteCompactor) compact(cd *CompactDef, stats *y.CompactionStats, dis
 	return newFileNames, nil
 }
 
+// remoteCompactionDialTimeout bounds the time to connect a remote compaction worker, so an
+// unreachable worker doesn't delay the failover.
+const remoteCompactionDialTimeout = 3 * time.Second
+
+// dial connects to the first available remote address.
+func (rc *remoteCompactor) dial() (conn net.Conn, err error) {
+	for _, addr := range rc.remoteAddrs {
+		conn, err = net.DialTimeout("tcp", addr, remoteCompactionDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		log.Warn("failed to connect remote compaction worker", zap.String("addr", addr), zap.Error(err))
+	}
+	return nil, err
+}
+
 func (rc *remoteCompactor) appendFiles(tbls []table.Table) error {
 	for _, tbl := range tbls {
 		sst := tbl.(*sstable.Table)
@@ -688,9 +715,10 @@ func (c *CompactionServer) handleConn(conn net.Conn) error {
 		}
 	}
 	cd.Level = req.Level
-	cd.Opt.MaxTableSize = req.MaxTableSize
 	cd.SafeTS = req.SafeTS
+	cd.RetainLatestVersionOnly = req.RetainLatestVersionOnly
 	cd.Opt = DefaultOptions.TableBuilderOptions
+	cd.Opt.MaxTableSize = req.MaxTableSize
 	cd.Opt.CompressionPerLevel = make([]options.CompressionType, 7)
 	cd.InMemory = true
 	stats := new(y.CompactionStats)
@@ -29,9 +29,9 @@ import (
 	"time"
 
 	"github.com/dgryski/go-farm"
-	"github.com/ncw/directio"
 	"github.com/pingcap/badger/cache"
 	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/fileutil"
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/protos"
 	"github.com/pingcap/badger/table"
@@ -65,7 +65,10 @@ type DB struct {
 	valueDirGuard *directoryLockGuard
 
 	closers   closers
+	closeMu   sync.RWMutex // Guards closed, held by writers while sending to the write worker.
+	closed    bool
 	mtbls     atomic.Value
+	flushErr  atomic.Value // The error that stopped the flush worker.
 	opt       Options
 	manifest  *manifestFile
 	lc        *levelsController
@@ -75,6 +78,10 @@ type DB struct {
 	writeCh   chan *request
 	flushChan chan *flushTask // For flushing memtables.
 	ingestCh  chan *ingestTask
+	// For Flush requests, handled by the write worker.
+	forceFlushCh chan *forceFlushTask
+	// For RotateValueLog requests, handled by the write worker.
+	rotateVLogCh chan *rotateVLogTask
 
 	// mem table buffer to avoid expensive allocating big chunk of memory
 	memTableCh chan *memtable.Table
@@ -82,7 +89,8 @@ type DB struct {
 	orc           *oracle
 	safeTsTracker safeTsTracker
 
-	limiter *rate.Limiter
+	limiter      *rate.Limiter
+	flushLimiter *rate.Limiter
 
 	blockCache *cache.Cache
 	indexCache *cache.Cache
@@ -115,10 +123,6 @@ func newMemTables(mt *memtable.Table, old *memTables) *memTables {
 	return newTbls
 }
 
-const (
-	kvWriteChCapacity = 1000
-)
-
 func replayFunction(out *DB) func(Entry) error {
 	type txnEntry struct {
 		nk y.Key
@@ -198,14 +202,50 @@ func replayFunction(out *DB) func(Entry) error {
 	}
 }
 
+// totalMemory is used to size the caches by fraction, it can be replaced in tests.
+var totalMemory = y.TotalMemory
+
+func resolveCacheSizes(opt *Options) error {
+	for _, fraction := range []float64{opt.BlockCacheMemFraction, opt.IndexCacheMemFraction} {
+		if fraction < 0 || fraction > 1 {
+			return ErrCacheMemFraction
+		}
+	}
+	useBlockFraction := opt.BlockCacheMemFraction > 0 && opt.MaxBlockCacheSize == 0
+	useIndexFraction := opt.IndexCacheMemFraction > 0 && opt.MaxIndexCacheSize == 0
+	if !useBlockFraction && !useIndexFraction {
+		return nil
+	}
+	total, err := totalMemory()
+	if err != nil {
+		return errors.Wrap(err, "failed to detect total memory")
+	}
+	if useBlockFraction {
+		opt.MaxBlockCacheSize = int64(float64(total) * opt.BlockCacheMemFraction)
+	}
+	if useIndexFraction {
+		opt.MaxIndexCacheSize = int64(float64(total) * opt.IndexCacheMemFraction)
+	}
+	return nil
+}
+
 // Open returns a new DB object.
 func Open(opt Options) (db *DB, err error) {
 	opt.maxBatchSize = (15 * opt.MaxMemTableSize) / 100
 	opt.maxBatchCount = opt.maxBatchSize / int64(memtable.MaxNodeSize)
+	if opt.RemoteCompactionAddr != "" {
+		opt.RemoteCompactionAddrs = append([]string{opt.RemoteCompactionAddr}, opt.RemoteCompactionAddrs...)
+	}
 
 	if opt.ValueThreshold > math.MaxUint16-16 {
 		return nil, ErrValueThreshold
 	}
+	if opt.WriteChannelCapacity < 0 {
+		return nil, ErrWriteChannelCapacity
+	}
+	if err = resolveCacheSizes(&opt); err != nil {
+		return nil, err
+	}
 
 	if opt.ReadOnly {
 		// Can't truncate if the DB is read only.
@@ -302,9 +342,11 @@ func Open(opt Options) (db *DB, err error) {
 	}
 	db = &DB{
 		flushChan:     make(chan *flushTask, opt.NumMemtables),
-		writeCh:       make(chan *request, kvWriteChCapacity),
+		writeCh:       make(chan *request, opt.WriteChannelCapacity),
 		memTableCh:    make(chan *memtable.Table, 1),
 		ingestCh:      make(chan *ingestTask),
+		forceFlushCh:  make(chan *forceFlushTask),
+		rotateVLogCh:  make(chan *rotateVLogTask),
 		opt:           opt,
 		manifest:      manifestFile,
 		dirLockGuard:  dirLockGuard,
@@ -321,6 +363,12 @@ func Open(opt Options) (db *DB, err error) {
 	if rateLimit > 0 {
 		db.limiter = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
 	}
+	if opt.FlushBytesPerSecond > 0 {
+		// The burst only needs to cover a single write buffer flush of the direct writer.
+		db.flushLimiter = rate.NewLimiter(rate.Limit(opt.FlushBytesPerSecond), opt.TableBuilderOptions.WriteBufferSize)
+	} else {
+		db.flushLimiter = db.limiter
+	}
 
 	// Calculate initial size.
 	db.calculateSize()
@@ -358,7 +406,12 @@ func Open(opt Options) (db *DB, err error) {
 		db.lc.startCompact(db.closers.compactors)
 
 		db.closers.memtable.AddRunning(1)
-		go db.runFlushMemTable(db.closers.memtable) // Need levels controller to be up.
+		go func() {
+			// Need levels controller to be up.
+			if err := db.runFlushMemTable(db.closers.memtable); err != nil {
+				db.flushErr.Store(err)
+			}
+		}()
 	}
 
 	if err = db.vlog.Open(db, opt); err != nil {
@@ -392,7 +445,7 @@ func Open(opt Options) (db *DB, err error) {
 	db.orc.nextCommit = db.orc.curRead + 1
 	db.orc.Unlock()
 
-	db.writeCh = make(chan *request, kvWriteChCapacity)
+	db.writeCh = make(chan *request, opt.WriteChannelCapacity)
 	db.closers.writes = startWriteWorker(db)
 
 	valueDirLockGuard = nil
@@ -484,18 +537,26 @@ type ExternalTableSpec struct {
 // IngestExternalFiles ingest external constructed tables into DB.
 // Note: insure there is no concurrent write overlap with tables to be ingested.
 func (db *DB) IngestExternalFiles(files []ExternalTableSpec) (int, error) {
+	db.closeMu.RLock()
+	if db.closed {
+		db.closeMu.RUnlock()
+		return 0, ErrDBClosed
+	}
 	tbls, err := db.prepareExternalFiles(files)
 	if err != nil {
+		db.closeMu.RUnlock()
 		return 0, err
 	}
 
 	if err := db.checkExternalTables(tbls); err != nil {
+		db.closeMu.RUnlock()
 		return 0, err
 	}
 
 	task := &ingestTask{tbls: tbls}
 	task.Add(1)
 	db.ingestCh <- task
+	db.closeMu.RUnlock()
 	task.Wait()
 	return task.cnt, task.err
 }
@@ -561,9 +622,16 @@ func (db *DB) CacheMetrics() *cache.Metrics {
 }
 
 // Close closes a DB. It's crucial to call it to ensure all the pending updates
-// make their way to disk. Calling DB.Close() multiple times is not safe and would
-// cause panic.
+// make their way to disk. Calling DB.Close() multiple times is safe, only the first
+// call closes the DB.
 func (db *DB) Close() (err error) {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.closeMu.Unlock()
 	log.Info("Closing database")
 
 	// Stop writes next.
@@ -766,6 +834,12 @@ func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
 		count++
 	}
 
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
 	// We can only service one request because we need each txn to be stored in a contigous section.
 	// Txns should not interleave among other txns or rewrites.
 	req := requestPool.Get().(*request)
@@ -828,12 +902,56 @@ func (db *DB) flushMemTable() *sync.WaitGroup {
 	db.mtbls.Store(newTbls)
 	ft := newFlushTask(mTbls.getMutable(), db.logOff)
 	db.flushChan <- ft
+	db.metrics.NumMemtableSwitches.Inc()
+	db.metrics.FlushQueueLength.Set(float64(len(db.flushChan)))
 	log.Info("flushing memtable", zap.Int64("memtable size", mTbls.getMutable().Size()), zap.Int("size of flushChan", len(db.flushChan)))
 
 	// New memtable is empty. We certainly have room.
 	return &ft.wg
 }
 
+// Flush forces the mutable memtable to be flushed even if it's not full, and waits until all
+// memtables are flushed to level 0. Writes which are done before Flush is called are included.
+func (db *DB) Flush() error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	task := &forceFlushTask{}
+	task.Add(1)
+	db.closeMu.RLock()
+	if db.closed {
+		db.closeMu.RUnlock()
+		return ErrDBClosed
+	}
+	db.forceFlushCh <- task
+	db.closeMu.RUnlock()
+	task.Wait()
+	if task.err != nil {
+		return task.err
+	}
+	task.flushed.Wait()
+	return nil
+}
+
+// RotateValueLog syncs and finishes the current value log file and starts a new one, the id of the
+// new file is returned. Writes which are done before RotateValueLog is called go to the old file.
+func (db *DB) RotateValueLog() (uint32, error) {
+	if db.opt.ReadOnly || db.volatileMode {
+		return 0, ErrInvalidRequest
+	}
+	task := &rotateVLogTask{}
+	task.Add(1)
+	db.closeMu.RLock()
+	if db.closed {
+		db.closeMu.RUnlock()
+		return 0, ErrDBClosed
+	}
+	db.rotateVLogCh <- task
+	db.closeMu.RUnlock()
+	task.Wait()
+	return task.fid, task.err
+}
+
 func arenaSize(opt Options) int64 {
 	return opt.MaxMemTableSize + opt.maxBatchCount*int64(memtable.MaxNodeSize)
 }
@@ -847,7 +965,7 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 		numWrite, bytesWrite int
 		err                  error
 	)
-	b := sstable.NewTableBuilder(f, db.limiter, 0, db.opt.TableBuilderOptions)
+	b := sstable.NewTableBuilder(f, db.flushLimiter, 0, db.opt.TableBuilderOptions)
 	defer b.Close()
 
 	for iter.Rewind(); iter.Valid(); y.NextAllVersion(iter) {
@@ -855,7 +973,7 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 		value := iter.Value()
 		if db.opt.ValueThreshold > 0 && len(value.Value) > db.opt.ValueThreshold {
 			if bb == nil {
-				if bb, err = db.newBlobFileBuilder(); err != nil {
+				if bb, err = db.newBlobFileBuilder(db.flushLimiter); err != nil {
 					return y.Wrap(err)
 				}
 			}
@@ -896,14 +1014,16 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 	return nil
 }
 
-func (db *DB) newBlobFileBuilder() (*blobFileBuilder, error) {
-	return newBlobFileBuilder(db.blobManger.allocFileID(), db.opt.Dir, db.opt.TableBuilderOptions.WriteBufferSize)
+func (db *DB) newBlobFileBuilder(limiter *rate.Limiter) (*blobFileBuilder, error) {
+	return newBlobFileBuilder(db.blobManger.allocFileID(), db.opt.Dir, db.opt.TableBuilderOptions.WriteBufferSize, db.opt.DisableDirectIO, limiter)
 }
 
 type flushTask struct {
 	mt  *memtable.Table
 	off logOffset
 	wg  sync.WaitGroup
+	// barrier task doesn't flush anything, it's done after all previous tasks are done.
+	barrier bool
 }
 
 func newFlushTask(mt *memtable.Table, off logOffset) *flushTask {
@@ -918,16 +1038,21 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 	defer c.Done()
 
 	for ft := range db.flushChan {
+		if ft.barrier {
+			ft.wg.Done()
+			continue
+		}
 		if ft.mt == nil {
 			return nil
 		}
+		db.metrics.FlushQueueLength.Set(float64(len(db.flushChan)))
 		guard := db.resourceMgr.Acquire()
 		var headInfo *protos.HeadInfo
 		if !ft.mt.Empty() {
 			headInfo = &protos.HeadInfo{
 				// Pick the max commit ts, so in case of crash, our read ts would be higher than all the
 				// commits.
-				Version:   db.orc.commitTs(),
+				Version:   db.orc.headTs(),
 				LogID:     ft.off.fid,
 				LogOffset: ft.off.offset,
 			}
@@ -937,7 +1062,7 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 
 		fileID := ft.mt.ID()
 		filename := sstable.NewFilename(fileID, db.opt.Dir)
-		fd, err := directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+		fd, err := fileutil.OpenDirectFile(filename, os.O_CREATE|os.O_RDWR, 0666, db.opt.DisableDirectIO)
 		if err != nil {
 			log.Error("error while writing to level 0", zap.Error(err))
 			return y.Wrap(err)
@@ -969,6 +1094,7 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 			log.Error("error while syncing level directory", zap.Error(err))
 			return err
 		}
+		db.lc.updateLevelZeroMetrics()
 		mTbls := db.mtbls.Load().(*memTables)
 		// Update the length of mTbls.
 		for i, tbl := range mTbls.tables {
@@ -1051,6 +1177,70 @@ func (db *DB) Size() (lsm int64, vlog int64) {
 	return atomic.LoadInt64(&db.lsmSize), atomic.LoadInt64(&db.vlogSize)
 }
 
+// PauseCompaction stops background compaction workers from picking new compactions, the running
+// ones are finished. Writes stall if level 0 has NumLevelZeroTablesStall tables while paused.
+func (db *DB) PauseCompaction() {
+	atomic.StoreInt32(&db.lc.compactionPaused, 1)
+}
+
+// ResumeCompaction resumes background compaction paused by PauseCompaction.
+func (db *DB) ResumeCompaction() {
+	atomic.StoreInt32(&db.lc.compactionPaused, 0)
+}
+
+// CompactL0 compacts all the current level 0 tables into level 1 and blocks until it's done. If a
+// level 0 compaction is already running, it waits for that one to finish and retries.
+func (db *DB) CompactL0() error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	for db.lc.levels[0].numTables() > 0 {
+		guard := db.resourceMgr.Acquire()
+		compacted, err := db.lc.doCompact(compactionPriority{level: 0}, guard)
+		guard.Done()
+		if compacted || err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Ready reports whether the DB can accept writes, if not, the reason is returned. It's cheap enough
+// to be called frequently by health checks.
+func (db *DB) Ready() (bool, string) {
+	db.closeMu.RLock()
+	closed := db.closed
+	db.closeMu.RUnlock()
+	if closed {
+		return false, "db is closed"
+	}
+	if db.opt.ReadOnly {
+		return false, "db is read only"
+	}
+	if err, ok := db.flushErr.Load().(error); ok {
+		return false, "memtable flush failed: " + err.Error()
+	}
+	if db.lc.levels[0].numTables() >= db.opt.NumLevelZeroTablesStall {
+		return false, "writes are stalled on level 0"
+	}
+	return true, ""
+}
+
+// LevelSizes returns the size of sstables in bytes for each level, it doesn't include blob files.
+func (db *DB) LevelSizes() []int64 {
+	sizes := make([]int64, len(db.lc.levels))
+	for i, l := range db.lc.levels {
+		sizes[i] = l.getTotalSize()
+	}
+	return sizes
+}
+
 func (db *DB) Tables() []TableInfo {
 	return db.lc.getTableInfo()
 }
@@ -1110,6 +1300,11 @@ func (db *DB) UpdateSafeTs(ts uint64) {
 	}
 }
 
+// SafeTs returns the safe ts set by UpdateSafeTs.
+func (db *DB) SafeTs() uint64 {
+	return db.getCompactSafeTs()
+}
+
 func (db *DB) IsManaged() bool {
 	return db.opt.ManagedTxns
 }
@@ -24,17 +24,23 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table/memtable"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -320,6 +326,436 @@ func TestForceCompactL0(t *testing.T) {
 	require.Equal(t, len(db.lc.levels[0].tables), 0)
 }
 
+func TestFlushMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.NumLevelZeroTables = 50
+	opts.NumLevelZeroTablesStall = 100
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := make([]byte, 4096)
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+	switches := testutil.ToFloat64(db.metrics.NumMemtableSwitches)
+	require.True(t, switches >= 3, "switches %v", switches)
+
+	// Every switched memtable ends up as a level 0 table once the flush queue is drained.
+	for i := 0; i < 100; i++ {
+		if testutil.ToFloat64(db.metrics.NumLevelZeroTables) == switches {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(t, switches, testutil.ToFloat64(db.metrics.NumLevelZeroTables))
+	require.Equal(t, float64(0), testutil.ToFloat64(db.metrics.FlushQueueLength))
+	require.Equal(t, int(switches), db.lc.levels[0].numTables())
+}
+
+func TestDisableDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DisableDirectIO = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	val := make([]byte, 4096)
+	n := 100
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			v, err := item.Value()
+			require.NoError(t, err)
+			require.Equal(t, val, v)
+		}
+		return nil
+	}))
+}
+
+func TestFlushRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.TableBuilderOptions.WriteBufferSize = 16 * 1024
+	opts.TableBuilderOptions.CompressionPerLevel = getTestCompression(options.None)
+	opts.FlushBytesPerSecond = 256 * 1024
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	mt := memtable.New(1<<20, db.lc.reserveFileID())
+	defer mt.Delete()
+	val := make([]byte, 4096)
+	for i := 0; i < 64; i++ {
+		rand.Read(val)
+		mt.PutToSkl([]byte(fmt.Sprintf("key%03d", i)), y.ValueStruct{Value: val, Version: 1})
+	}
+	fd, err := ioutil.TempFile(dir, "flush")
+	require.NoError(t, err)
+	defer fd.Close()
+
+	// 256KB at 256KB/s, only the first write buffer is covered by the burst.
+	start := time.Now()
+	require.NoError(t, db.writeLevel0Table(mt, fd))
+	require.True(t, time.Since(start) >= 800*time.Millisecond, "flush took %v", time.Since(start))
+}
+
+func TestFlushRateLimitFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.BytesPerSecond = 1 << 30
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	// Without FlushBytesPerSecond, flush is throttled by the compaction limiter.
+	require.NotNil(t, db.limiter)
+	require.True(t, db.flushLimiter == db.limiter)
+}
+
+func TestRotateValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+	}
+	oldFid := db.vlog.maxFid()
+	fid, err := db.RotateValueLog()
+	require.NoError(t, err)
+	require.Equal(t, oldFid+1, fid)
+	for i := 10; i < 20; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+	}
+	require.Equal(t, fid, db.vlog.maxFid())
+	for _, f := range []uint32{oldFid, fid} {
+		_, err = os.Stat(db.vlog.fpath(f))
+		require.NoError(t, err)
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 20; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("val%d", i)), getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestRotateValueLogSyncWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Keep writes pending while the value log is rotated.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("key%d-%d", w, i)), []byte("val"), 0)
+			}
+		}(w)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := db.RotateValueLog()
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for w := 0; w < 4; w++ {
+			for i := 0; i < 200; i++ {
+				_, err := txn.Get([]byte(fmt.Sprintf("key%d-%d", w, i)))
+				require.NoError(t, err)
+			}
+		}
+		return nil
+	}))
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+	}
+	require.NoError(t, db.Flush())
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+	mTbls := db.mtbls.Load().(*memTables)
+	require.Equal(t, uint32(1), atomic.LoadUint32(&mTbls.length))
+	require.True(t, mTbls.getMutable().Empty())
+
+	// Nothing to flush.
+	require.NoError(t, db.Flush())
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%d", i)), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestWriteChannelCapacity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.WriteChannelCapacity = 4
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 4, cap(db.writeCh))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 16; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+		}
+		return nil
+	}))
+}
+
+func TestWriteChannelBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.WriteChannelCapacity = -1
+	_, err = OpenManaged(opts)
+	require.Equal(t, ErrWriteChannelCapacity, err)
+
+	opts.WriteChannelCapacity = 4
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Block the write worker: an ingest task waits for the write lock before draining the channel.
+	db.orc.writeLock.Lock()
+	task := &ingestTask{}
+	task.Add(1)
+	db.ingestCh <- task
+
+	send := func(i int) *request {
+		req, err := db.sendToWriteCh([]*Entry{{
+			Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1),
+			Value: []byte("val"),
+		}})
+		require.NoError(t, err)
+		return req
+	}
+	var reqs []*request
+	for i := 0; i < 4; i++ {
+		reqs = append(reqs, send(i))
+	}
+	require.Equal(t, 4, len(db.writeCh))
+	blocked := make(chan *request)
+	go func() {
+		blocked <- send(4)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("write is not blocked by the full channel")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the worker drains the channel, the blocked write is accepted.
+	db.orc.writeLock.Unlock()
+	task.Wait()
+	require.NoError(t, task.err)
+	reqs = append(reqs, <-blocked)
+	for _, req := range reqs {
+		require.NoError(t, req.Wait())
+	}
+	txn := db.NewTransactionAt(1, false)
+	defer txn.Discard()
+	for i := 0; i < 5; i++ {
+		_, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+	}
+}
+
+func TestLevelSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+		if i%25 == 24 {
+			require.NoError(t, db.Flush())
+		}
+	}
+	var l0Size int64
+	for _, tbl := range db.Tables() {
+		require.Equal(t, 0, tbl.Level)
+		info, err := os.Stat(sstable.NewFilename(tbl.ID, dir))
+		require.NoError(t, err)
+		l0Size += info.Size()
+	}
+	sizes := db.LevelSizes()
+	require.Len(t, sizes, opts.TableBuilderOptions.MaxLevels)
+	require.Equal(t, l0Size, sizes[0])
+	for _, size := range sizes[1:] {
+		require.Equal(t, int64(0), size)
+	}
+}
+
+func TestPauseCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.NumLevelZeroTables = 2
+	opts.NumLevelZeroTablesStall = 100
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	db.PauseCompaction()
+	for i := 0; i < 5; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		require.NoError(t, db.Flush())
+	}
+	time.Sleep(time.Second)
+	require.Equal(t, 5, db.lc.levels[0].numTables())
+
+	db.ResumeCompaction()
+	for i := 0; i < 100 && db.lc.levels[0].numTables() >= opts.NumLevelZeroTables; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, db.lc.levels[0].numTables() < opts.NumLevelZeroTables)
+}
+
+func TestCloseTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	numGoroutines := runtime.NumGoroutine()
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key2"), []byte("val")))
+	require.Equal(t, ErrDBClosed, txn.Commit())
+	require.Equal(t, ErrDBClosed, db.Flush())
+	f := buildSst(t, [][]byte{[]byte("key3")}, [][]byte{[]byte("val")})
+	defer os.Remove(f.Name())
+	_, err = db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}})
+	require.Equal(t, ErrDBClosed, err)
+
+	// All background goroutines should exit after close.
+	for i := 0; i < 100 && runtime.NumGoroutine() > numGoroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, runtime.NumGoroutine() <= numGoroutines, "%d > %d", runtime.NumGoroutine(), numGoroutines)
+}
+
+func TestCommitObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	type observed struct {
+		key     string
+		version uint64
+		deleted bool
+	}
+	var (
+		mu   sync.Mutex
+		seen []observed
+	)
+	opts := getTestOptions(dir)
+	opts.CommitObserver = func(e *Entry) {
+		mu.Lock()
+		seen = append(seen, observed{string(e.Key.UserKey), e.Key.Version, e.IsDeleted()})
+		mu.Unlock()
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var expected []observed
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i%3)
+		txn := db.NewTransaction(true)
+		if i%4 == 3 {
+			require.NoError(t, txn.Delete([]byte(key)))
+		} else {
+			require.NoError(t, txn.Set([]byte(key), []byte("val")))
+		}
+		require.NoError(t, txn.Commit())
+		expected = append(expected, observed{key, db.orc.readTs(), i%4 == 3})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, expected, seen)
+}
+
 // Put a lot of data to move some data to disk.
 // WARNING: This test might take a while but it should pass!
 func TestGetMore(t *testing.T) {
@@ -668,6 +1104,59 @@ func TestIterateDeleted(t *testing.T) {
 	})
 }
 
+func TestIteratePrefix(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, prefix := range []string{"a", "b", "bb", "c"} {
+			for i := 0; i < 10; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("%s/%02d", prefix, i)), []byte("v"), 0x00)
+			}
+		}
+		// Flush half of the data so the iterator covers both memtables and L0.
+		require.NoError(t, db.Flush())
+		for i := 10; i < 20; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("b/%02d", i)), []byte("v"), 0x00)
+		}
+
+		collect := func(reverse bool, seek []byte) []string {
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				opt := DefaultIteratorOptions
+				opt.Prefix = []byte("b/")
+				opt.Reverse = reverse
+				it := txn.NewIterator(opt)
+				defer it.Close()
+				if seek == nil {
+					it.Rewind()
+				} else {
+					it.Seek(seek)
+				}
+				for ; it.Valid(); it.Next() {
+					keys = append(keys, string(it.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		var expected []string
+		for i := 0; i < 20; i++ {
+			expected = append(expected, fmt.Sprintf("b/%02d", i))
+		}
+		require.Equal(t, expected, collect(false, nil))
+		require.Equal(t, expected, collect(false, []byte("a")))
+		require.Equal(t, expected[5:], collect(false, []byte("b/05")))
+		require.Len(t, collect(false, []byte("c")), 0)
+
+		var reversed []string
+		for i := len(expected) - 1; i >= 0; i-- {
+			reversed = append(reversed, expected[i])
+		}
+		require.Equal(t, reversed, collect(true, nil))
+		require.Equal(t, reversed, collect(true, []byte("z")))
+		require.Equal(t, reversed[14:], collect(true, []byte("b/05")))
+	})
+}
+
 func TestDeleteWithoutSyncWrite(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
@@ -702,6 +1191,157 @@ func TestDeleteWithoutSyncWrite(t *testing.T) {
 	}))
 }
 
+func TestCacheMemFraction(t *testing.T) {
+	oldTotalMemory := totalMemory
+	defer func() { totalMemory = oldTotalMemory }()
+	totalMemory = func() (uint64, error) { return 1 << 30, nil }
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.MaxBlockCacheSize = 0
+	opts.MaxIndexCacheSize = 32 << 20
+	opts.BlockCacheMemFraction = 0.25
+	opts.IndexCacheMemFraction = 0.5
+	db, err := Open(opts)
+	require.NoError(t, err)
+	// The fraction is applied to a cleared size, but not to an explicit one.
+	require.Equal(t, int64(256<<20), db.opt.MaxBlockCacheSize)
+	require.Equal(t, int64(32<<20), db.opt.MaxIndexCacheSize)
+	require.NotNil(t, db.blockCache)
+	require.NoError(t, db.Close())
+
+	totalMemory = func() (uint64, error) { return 0, errors.New("no memory info") }
+	_, err = Open(opts)
+	require.Error(t, err)
+
+	// The total memory isn't needed if both sizes are explicit.
+	opts.MaxBlockCacheSize = 64 << 20
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), db.opt.MaxBlockCacheSize)
+	require.NoError(t, db.Close())
+
+	for _, fraction := range []float64{-0.1, 1.5} {
+		opts.BlockCacheMemFraction = fraction
+		_, err = Open(opts)
+		require.Equal(t, ErrCacheMemFraction, err)
+	}
+}
+
+func TestCompactL0(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.NumLevelZeroTables = 10
+	opts.NumLevelZeroTablesStall = 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d-%d", i, j)), []byte("val"), 0)
+		}
+		require.NoError(t, db.Flush())
+	}
+	require.Equal(t, 4, db.lc.levels[0].numTables())
+	require.NoError(t, db.CompactL0())
+	require.Equal(t, 0, db.lc.levels[0].numTables())
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 10; j++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d-%d", i, j)))
+				require.NoError(t, err)
+				require.Equal(t, []byte("val"), getItemValue(t, item))
+			}
+		}
+		return nil
+	}))
+}
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.NumLevelZeroTables = 1
+	opts.NumLevelZeroTablesStall = 2
+	db, err := Open(opts)
+	require.NoError(t, err)
+	ready, reason := db.Ready()
+	require.True(t, ready)
+	require.Equal(t, "", reason)
+
+	// Level 0 reaches the stall threshold while compaction is paused.
+	db.PauseCompaction()
+	for i := 0; i < 2; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		require.NoError(t, db.Flush())
+	}
+	ready, reason = db.Ready()
+	require.False(t, ready)
+	require.Equal(t, "writes are stalled on level 0", reason)
+	db.ResumeCompaction()
+	for i := 0; i < 100 && db.lc.levels[0].numTables() >= 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	ready, reason = db.Ready()
+	require.True(t, ready)
+	require.Equal(t, "", reason)
+
+	db.flushErr.Store(errors.New("disk full"))
+	ready, reason = db.Ready()
+	require.False(t, ready)
+	require.Equal(t, "memtable flush failed: disk full", reason)
+
+	require.NoError(t, db.Close())
+	ready, reason = db.Ready()
+	require.False(t, ready)
+	require.Equal(t, "db is closed", reason)
+}
+
+func TestCompactL0KeepsTombstone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	// Make level 1 compactable with a single small table.
+	opts.LevelOneSize = 1
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := []byte("k")
+	txn := db.NewTransactionAt(1, true)
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs(key, 1), Value: []byte("v")}))
+	require.NoError(t, txn.CommitAt(1))
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	// Push the value down to level 2.
+	guard := db.resourceMgr.Acquire()
+	compacted, err := db.lc.doCompact(compactionPriority{level: 1}, guard)
+	guard.Done()
+	require.NoError(t, err)
+	require.True(t, compacted)
+	require.Equal(t, 1, db.lc.levels[2].numTables())
+
+	txn = db.NewTransactionAt(5, true)
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs(key, 5), meta: bitDelete}))
+	require.NoError(t, txn.CommitAt(5))
+	require.NoError(t, db.Flush())
+	db.UpdateSafeTs(10)
+	require.NoError(t, db.CompactL0())
+
+	// The tombstone must be kept since level 2 still has the old value.
+	txn = db.NewTransactionAt(20, false)
+	defer txn.Discard()
+	_, err = txn.Get(key)
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
 func TestPidFile(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		// Reopen database
@@ -1222,6 +1862,308 @@ func TestCompactionFilter(t *testing.T) {
 	// require.True(t, dropAppearOldCount > 0)
 }
 
+type upperCaseFilter struct{}
+
+func (f *upperCaseFilter) Filter(key, val, userMeta []byte) Decision {
+	return DecisionRewrite
+}
+
+func (f *upperCaseFilter) Rewrite(key, val, userMeta []byte) []byte {
+	return bytes.ToUpper(val)
+}
+
+func (f *upperCaseFilter) Guards() []Guard {
+	return nil
+}
+
+func TestCompactionFilterRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &upperCaseFilter{}
+	}
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	n := 100
+	for i := 0; i < n; i++ {
+		txn := db.NewTransactionAt(1, true)
+		require.NoError(t, txn.SetEntry(&Entry{
+			Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 2),
+			Value: []byte(fmt.Sprintf("val%d", i)),
+		}))
+		require.NoError(t, txn.CommitAt(2))
+	}
+	db.UpdateSafeTs(2)
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	require.Equal(t, 0, db.lc.levels[0].numTables())
+	txn := db.NewTransactionAt(2, false)
+	defer txn.Discard()
+	for i := 0; i < n; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("VAL%d", i)), getItemValue(t, item))
+	}
+}
+
+type finalizeFilter struct {
+	filtered  int
+	finalized int
+	// the number of filtered keys when Finalize is called.
+	filteredAtFinalize int
+}
+
+func (f *finalizeFilter) Filter(key, val, userMeta []byte) Decision {
+	f.filtered++
+	return DecisionKeep
+}
+
+func (f *finalizeFilter) Finalize() error {
+	f.finalized++
+	f.filteredAtFinalize = f.filtered
+	return nil
+}
+
+func (f *finalizeFilter) Guards() []Guard {
+	return nil
+}
+
+func TestCompactionFilterFinalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	var mu sync.Mutex
+	var filters []*finalizeFilter
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		mu.Lock()
+		defer mu.Unlock()
+		f := &finalizeFilter{}
+		filters = append(filters, f)
+		return f
+	}
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		txn := db.NewTransactionAt(1, true)
+		require.NoError(t, txn.SetEntry(&Entry{
+			Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 2),
+			Value: []byte(fmt.Sprintf("val%d", i)),
+		}))
+		require.NoError(t, txn.CommitAt(2))
+	}
+	db.UpdateSafeTs(2)
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, filters)
+	var filtered int
+	for _, f := range filters {
+		require.Equal(t, 1, f.finalized)
+		require.Equal(t, f.filtered, f.filteredAtFinalize)
+		filtered += f.filtered
+	}
+	require.Equal(t, 100, filtered)
+}
+
+type versionFilter struct {
+	cutoff uint64
+}
+
+func (f *versionFilter) Filter(key, val, userMeta []byte) Decision {
+	return DecisionKeep
+}
+
+func (f *versionFilter) FilterWithVersion(key, val, userMeta []byte, version uint64) Decision {
+	if version < f.cutoff {
+		return DecisionDrop
+	}
+	return DecisionKeep
+}
+
+func (f *versionFilter) Guards() []Guard {
+	return nil
+}
+
+func TestVersionedFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &versionFilter{cutoff: 50}
+	}
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	n := 100
+	for i := 0; i < n; i++ {
+		version := uint64(i + 1)
+		txn := db.NewTransactionAt(version, true)
+		require.NoError(t, txn.SetEntry(&Entry{
+			Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), version),
+			Value: []byte("val"),
+		}))
+		require.NoError(t, txn.CommitAt(version))
+	}
+	db.UpdateSafeTs(uint64(n))
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	txn := db.NewTransactionAt(uint64(n), false)
+	defer txn.Discard()
+	for i := 0; i < n; i++ {
+		_, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+		if uint64(i+1) < 50 {
+			require.Equal(t, ErrKeyNotFound, err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestRetainLatestVersionOnly(t *testing.T) {
+	countVersions := func(retainLatest bool) map[string]int {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := getTestOptions(dir)
+		opts.RetainLatestVersionOnly = retainLatest
+		db, err := OpenManaged(opts)
+		require.NoError(t, err)
+		defer db.Close()
+		for version := uint64(1); version <= 5; version++ {
+			for i := 0; i < 10; i++ {
+				txn := db.NewTransactionAt(version, true)
+				require.NoError(t, txn.SetEntry(&Entry{
+					Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), version),
+					Value: []byte(fmt.Sprintf("val%d", version)),
+				}))
+				require.NoError(t, txn.CommitAt(version))
+			}
+		}
+		// The safe ts is not updated, so all versions are kept by default.
+		require.NoError(t, db.Flush())
+		require.NoError(t, db.CompactL0())
+
+		versions := make(map[string]int)
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		defer txn.Discard()
+		opt := DefaultIteratorOptions
+		opt.AllVersions = true
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			versions[string(item.Key())]++
+			if retainLatest {
+				require.Equal(t, []byte("val5"), getItemValue(t, item))
+			}
+		}
+		return versions
+	}
+	versions := countVersions(false)
+	require.Len(t, versions, 10)
+	for _, n := range versions {
+		require.Equal(t, 5, n)
+	}
+	versions = countVersions(true)
+	require.Len(t, versions, 10)
+	for _, n := range versions {
+		require.Equal(t, 1, n)
+	}
+}
+
+func TestTargetFileSizeByLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.ValueThreshold = 0
+	opts.NumLevelZeroTables = 20
+	opts.NumLevelZeroTablesStall = 40
+	opts.TableBuilderOptions.CompressionPerLevel = getTestCompression(options.None)
+	targetSize := 4 * opts.TableBuilderOptions.MaxTableSize
+	opts.TargetFileSizeByLevel = []int64{0, targetSize, 0, 2 * targetSize}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, opts.TableBuilderOptions.MaxTableSize, db.opt.targetFileSize(2))
+	require.Equal(t, 2*targetSize, db.opt.targetFileSize(3))
+	require.Equal(t, opts.TableBuilderOptions.MaxTableSize, db.opt.targetFileSize(4))
+	cd := &CompactDef{Level: 2}
+	db.lc.prepareCompactionDef(cd)
+	require.Equal(t, 2*targetSize, cd.Opt.MaxTableSize)
+
+	for i := 0; i < 2048; i++ {
+		val := make([]byte, 1024)
+		rand.Read(val)
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), val, 0)
+	}
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	tables := db.lc.levels[1].tables
+	require.True(t, len(tables) > 1)
+	for _, tbl := range tables[:len(tables)-1] {
+		require.True(t, tbl.Size() > opts.TableBuilderOptions.MaxTableSize)
+		require.True(t, tbl.Size() <= targetSize+2*int64(opts.TableBuilderOptions.BlockSize))
+	}
+}
+
+type dynamicGuardFilter struct{}
+
+func (f *dynamicGuardFilter) Filter(key, val, userMeta []byte) Decision {
+	return DecisionKeep
+}
+
+func (f *dynamicGuardFilter) Guards() []Guard {
+	return nil
+}
+
+func (f *dynamicGuardFilter) DynamicGuard(key []byte) bool {
+	return bytes.HasPrefix(key, []byte("b"))
+}
+
+func TestDynamicGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &dynamicGuardFilter{}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("%s%d", prefix, i)), []byte("val"), 0)
+		}
+	}
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	var bounds []string
+	for _, tbl := range db.Tables() {
+		require.Equal(t, 1, tbl.Level)
+		bounds = append(bounds, string(tbl.Left), string(tbl.Right))
+	}
+	// Every key with prefix "b" finishes a file.
+	expected := []string{"a0", "b0"}
+	for i := 1; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("b%d", i), fmt.Sprintf("b%d", i))
+	}
+	expected = append(expected, "c0", "c9")
+	require.Equal(t, expected, bounds)
+}
+
 func (f *testFilter) Guards() []Guard {
 	return []Guard{
 		{
@@ -1266,6 +2208,44 @@ func TestSearchGuard(t *testing.T) {
 	}
 }
 
+type invalidGuardFilter struct{}
+
+func (f *invalidGuardFilter) Filter(key, val, userMeta []byte) Decision {
+	return DecisionKeep
+}
+
+func (f *invalidGuardFilter) Guards() []Guard {
+	return []Guard{{Prefix: []byte("k"), MatchLen: 3, MinSize: -1}}
+}
+
+func TestInvalidGuard(t *testing.T) {
+	require.NoError(t, validateGuards((&testFilter{}).Guards()))
+	require.Equal(t, ErrInvalidGuard, errors.Cause(validateGuards([]Guard{{MatchLen: -1}})))
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.CompactL0WhenClose = false
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &invalidGuardFilter{}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	require.NoError(t, db.Flush())
+
+	cd := &CompactDef{}
+	guard := db.resourceMgr.Acquire()
+	defer guard.Done()
+	require.True(t, cd.fillTablesL0(&db.lc.cstatus, db.lc.levels[0], db.lc.levels[1]))
+	err = db.lc.runCompactDef(cd, guard)
+	require.Equal(t, ErrInvalidGuard, errors.Cause(err))
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+}
+
 func TestShouldFinishFile(t *testing.T) {
 	tests1 := []struct {
 		key     []byte
@@ -1451,6 +2431,38 @@ func TestIngestSimple(t *testing.T) {
 	}
 }
 
+func TestIngestLevelZeroMetrics(t *testing.T) {
+	var ingestKeys [][]byte
+	for i := 1500; i < 2500; i++ {
+		ingestKeys = append(ingestKeys, []byte(fmt.Sprintf("key%04d", i)))
+	}
+	f := buildSst(t, ingestKeys, ingestKeys)
+	defer os.Remove(f.Name())
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 1000; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		txnSet(t, db, key, key, 0)
+	}
+	require.NoError(t, db.Flush())
+	require.Equal(t, float64(1), testutil.ToFloat64(db.metrics.NumLevelZeroTables))
+
+	// The ingested table overlaps the level 0 table, so it's added to level 0.
+	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}})
+	require.NoError(t, err)
+	require.Equal(t, 1, cnt)
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	require.Equal(t, float64(2), testutil.ToFloat64(db.metrics.NumLevelZeroTables))
+}
+
 func TestIngestOverwrite(t *testing.T) {
 	var ingestKeys, ingestVals [][]byte
 	for i := 0; i < 1000; i++ {
@@ -1865,3 +2877,89 @@ func TestRemoteCompaction(t *testing.T) {
 		return nil
 	})
 }
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestRemoteCompactionFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	liveListener := &countingListener{Listener: l}
+	compactionServer := &CompactionServer{l: liveListener}
+	go compactionServer.Run()
+	defer compactionServer.Close()
+	liveAddr := l.Addr().String()
+
+	rc := &remoteCompactor{remoteAddrs: []string{deadAddr, liveAddr}}
+	conn, err := rc.dial()
+	require.NoError(t, err)
+	require.Equal(t, liveAddr, conn.RemoteAddr().String())
+	conn.Close()
+	rc = &remoteCompactor{remoteAddrs: []string{deadAddr}}
+	_, err = rc.dial()
+	require.Error(t, err)
+
+	runCompaction := func(addrs []string) {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := getTestOptions(dir)
+		opts.ValueThreshold = 0
+		opts.RemoteCompactionAddrs = addrs
+		opts.TableBuilderOptions.MaxTableSize = 32 * 1024
+		opts.MaxMemTableSize = 32 * 1024
+		opts.NumMemtables = 2
+		opts.NumLevelZeroTables = 1
+		opts.NumLevelZeroTablesStall = 2
+		db, err := Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+		val := make([]byte, 1024)
+		for i := 0; i < 256; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), val, 0)
+		}
+		compacted := func() bool {
+			for _, size := range db.LevelSizes()[1:] {
+				if size > 0 {
+					return true
+				}
+			}
+			return false
+		}
+		for i := 0; i < 100 && !compacted(); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		require.True(t, compacted())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 256; i++ {
+				_, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+	}
+
+	// Compactions fail over to the live worker.
+	accepted := atomic.LoadInt32(&liveListener.accepted)
+	runCompaction([]string{deadAddr, liveAddr})
+	require.True(t, atomic.LoadInt32(&liveListener.accepted) > accepted)
+
+	// Compaction falls back to local if no remote worker is available.
+	accepted = atomic.LoadInt32(&liveListener.accepted)
+	runCompaction([]string{deadAddr})
+	require.Equal(t, accepted, atomic.LoadInt32(&liveListener.accepted))
+}
@@ -31,6 +31,13 @@ var (
 	// uint16.
 	ErrValueThreshold = errors.New("Invalid ValueThreshold, must be lower than uint16.")
 
+	// ErrWriteChannelCapacity is returned when WriteChannelCapacity is negative.
+	ErrWriteChannelCapacity = errors.New("Invalid WriteChannelCapacity, must not be negative")
+
+	// ErrCacheMemFraction is returned when BlockCacheMemFraction or IndexCacheMemFraction is not
+	// within [0, 1].
+	ErrCacheMemFraction = errors.New("Invalid cache memory fraction, must be between 0 and 1")
+
 	// ErrKeyNotFound is returned when key isn't found on a txn.Get.
 	ErrKeyNotFound = errors.New("Key not found")
 
@@ -76,6 +83,18 @@ var (
 	ErrManagedTxn = errors.New(
 		"Invalid API request. Not allowed to perform this action using ManagedDB")
 
+	// ErrCommitTsGoBack is returned by SetCommitTs if the given ts is smaller than the current one.
+	ErrCommitTsGoBack = errors.New("Commit ts can not go back")
+
+	// ErrInvalidGuard is returned by compaction if a Guard returned by the CompactionFilter is invalid.
+	ErrInvalidGuard = errors.New("Invalid compaction guard")
+
+	// ErrManifestCorrupt is returned by Open if the MANIFEST file is broken.
+	ErrManifestCorrupt = errors.New("MANIFEST file is corrupt")
+
+	// ErrDBClosed is returned if a write is done after the DB is closed.
+	ErrDBClosed = errors.New("DB is closed")
+
 	// ErrInvalidDump if a data dump made previously cannot be loaded into the database.
 	ErrInvalidDump = errors.New("Data dump cannot be read")
 
@@ -0,0 +1,27 @@
+package fileutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/ncw/directio"
+)
+
+// OpenDirectFile opens a file to be written by DirectWriter.
+// If disableDirectIO is true, or the file system doesn't support O_DIRECT (e.g. tmpfs), the file
+// is opened without O_DIRECT. DirectWriter works on such a file too, the writes just go through
+// the page cache.
+func OpenDirectFile(name string, flag int, perm os.FileMode, disableDirectIO bool) (*os.File, error) {
+	if !disableDirectIO {
+		fd, err := directio.OpenFile(name, flag, perm)
+		if err == nil || !isDirectIOUnsupported(err) {
+			return fd, err
+		}
+	}
+	return os.OpenFile(name, flag, perm)
+}
+
+func isDirectIOUnsupported(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.EINVAL
+}
@@ -2,7 +2,9 @@ package fileutil
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ncw/directio"
@@ -65,3 +67,26 @@ func setVal(buf []byte, v byte) {
 		buf[i] = v
 	}
 }
+
+func TestOpenDirectFileFallback(t *testing.T) {
+	// tmpfs rejects O_DIRECT, OpenDirectFile should fall back to a normal file.
+	dir := "/dev/shm"
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Skip("tmpfs is not available")
+	}
+	for _, disableDirectIO := range []bool{false, true} {
+		fileName := filepath.Join(dir, "direct_fallback_test")
+		fd, err := OpenDirectFile(fileName, os.O_CREATE|os.O_RDWR, 0666, disableDirectIO)
+		require.Nil(t, err)
+		writer := NewDirectWriter(fd, directio.BlockSize, nil)
+		val := make([]byte, 1000)
+		setVal(val, 1)
+		require.Nil(t, writer.Append(val))
+		require.Nil(t, writer.Finish())
+		fd.Close()
+		data, err := ioutil.ReadFile(fileName)
+		require.Nil(t, err)
+		require.Equal(t, val, data)
+		require.Nil(t, os.Remove(fileName))
+	}
+}
@@ -166,6 +166,11 @@ type IteratorOptions struct {
 	StartKey y.Key
 	EndKey   y.Key
 
+	// Prefix limits the iteration to keys sharing the prefix. Seek and Rewind are clamped to the
+	// prefix and the iterator becomes invalid once it passes the last matching key. If StartKey
+	// and EndKey are not set, they are derived from the prefix to prune tables.
+	Prefix []byte
+
 	internalAccess bool // Used to allow internal access to badger keys.
 }
 
@@ -256,10 +261,11 @@ type Iterator struct {
 	txn    *Txn
 	readTs uint64
 
-	opt   IteratorOptions
-	item  *Item
-	itBuf Item
-	vs    y.ValueStruct
+	opt       IteratorOptions
+	prefixEnd []byte
+	item      *Item
+	itBuf     Item
+	vs        y.ValueStruct
 
 	closed bool
 }
@@ -271,6 +277,11 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	atomic.AddInt32(&txn.numIterators, 1)
 
 	tables := txn.db.getMemTables()
+	prefixEnd := prefixSuccessor(opt.Prefix)
+	if len(opt.Prefix) > 0 && opt.StartKey.IsEmpty() && opt.EndKey.IsEmpty() && prefixEnd != nil {
+		opt.StartKey = y.KeyWithTs(opt.Prefix, 0)
+		opt.EndKey = y.KeyWithTs(prefixEnd, 0)
+	}
 	if !opt.StartKey.IsEmpty() {
 		opt.StartKey.Version = math.MaxUint64
 	}
@@ -288,10 +299,11 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	}
 	iters = txn.db.lc.appendIterators(iters, &opt) // This will increment references.
 	res := &Iterator{
-		txn:    txn,
-		iitr:   table.NewMergeIterator(iters, opt.Reverse),
-		opt:    opt,
-		readTs: txn.readTs,
+		txn:       txn,
+		iitr:      table.NewMergeIterator(iters, opt.Reverse),
+		opt:       opt,
+		prefixEnd: prefixEnd,
+		readTs:    txn.readTs,
 	}
 	res.itBuf.db = txn.db
 	res.itBuf.txn = txn
@@ -299,6 +311,19 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	return res
 }
 
+// prefixSuccessor returns the smallest key greater than every key with the given prefix, or nil if
+// there is no such key.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
 // Item returns pointer to the current key-value pair.
 // This item is only valid until it.Next() gets called.
 func (it *Iterator) Item() *Item {
@@ -359,6 +384,14 @@ func (it *Iterator) parseItem() {
 			iitr.Next()
 			continue
 		}
+		if len(it.opt.Prefix) > 0 && !bytes.HasPrefix(key.UserKey, it.opt.Prefix) {
+			// In reverse mode keys after the prefix are skipped until we reach it.
+			if it.opt.Reverse && bytes.Compare(key.UserKey, it.opt.Prefix) > 0 {
+				iitr.Next()
+				continue
+			}
+			break
+		}
 		if key.Version > it.readTs {
 			if !y.SeekToVersion(iitr, it.readTs) {
 				iitr.Next()
@@ -383,6 +416,13 @@ func isDeleted(meta byte) bool {
 // greater than provided if iterating in the forward direction. Behavior would be reversed is
 // iterating backwards.
 func (it *Iterator) Seek(key []byte) {
+	if len(it.opt.Prefix) > 0 {
+		if !it.opt.Reverse && bytes.Compare(key, it.opt.Prefix) < 0 {
+			key = it.opt.Prefix
+		} else if it.opt.Reverse && it.prefixEnd != nil && (len(key) == 0 || bytes.Compare(key, it.prefixEnd) > 0) {
+			key = it.prefixEnd
+		}
+	}
 	if !it.opt.Reverse {
 		it.iitr.Seek(key)
 	} else {
@@ -399,6 +439,10 @@ func (it *Iterator) Seek(key []byte) {
 // smallest key if iterating forward, and largest if iterating backward. It does not keep track of
 // whether the cursor started with a Seek().
 func (it *Iterator) Rewind() {
+	if len(it.opt.Prefix) > 0 {
+		it.Seek(nil)
+		return
+	}
 	it.iitr.Rewind()
 	it.parseItem()
 }
@@ -21,10 +21,11 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"sync/atomic"
 	"time"
 
-	"github.com/ncw/directio"
 	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/fileutil"
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/protos"
 	"github.com/pingcap/badger/table"
@@ -36,7 +37,9 @@ import (
 )
 
 type levelsController struct {
-	nextFileID uint64 // Atomic
+	nextFileID       uint64 // Atomic
+	nextRemoteAddr   uint32 // Atomic
+	compactionPaused int32  // Atomic
 
 	// The following are initialized once and const.
 	resourceMgr *epoch.ResourceManager
@@ -133,6 +136,7 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 	for i, tbls := range tables {
 		s.levels[i].initTables(tbls)
 	}
+	s.updateLevelZeroMetrics()
 
 	// Make sure key ranges do not overlap etc.
 	if err := s.validate(); err != nil {
@@ -189,7 +193,10 @@ func (lc *levelsController) runWorker(c *y.Closer, scorePriority bool) {
 
 	for {
 		guard := lc.resourceMgr.Acquire()
-		prios := lc.pickCompactLevels()
+		var prios []compactionPriority
+		if atomic.LoadInt32(&lc.compactionPaused) == 0 {
+			prios = lc.pickCompactLevels()
+		}
 		if scorePriority {
 			sort.Slice(prios, func(i, j int) bool {
 				return prios[i].score > prios[j].score
@@ -347,6 +354,16 @@ func searchGuard(key []byte, guards []Guard) *Guard {
 	return maxMatchGuard
 }
 
+func validateGuards(guards []Guard) error {
+	for _, guard := range guards {
+		if guard.MatchLen < 0 || guard.MinSize < 0 {
+			return errors.Wrapf(ErrInvalidGuard, "prefix %q, match len %d, min size %d",
+				guard.Prefix, guard.MatchLen, guard.MinSize)
+		}
+	}
+	return nil
+}
+
 func overSkipTables(key y.Key, skippedTables []table.Table) (newSkippedTables []table.Table, over bool) {
 	var i int
 	for i < len(skippedTables) {
@@ -370,17 +387,27 @@ func (lc *levelsController) prepareCompactionDef(cd *CompactDef) {
 		cd.Guards = cd.Filter.Guards()
 	}
 	cd.Opt = lc.opt
+	cd.Opt.MaxTableSize = lc.kv.opt.targetFileSize(cd.Level + 1)
 	cd.Dir = lc.kv.opt.Dir
 	cd.AllocIDFunc = lc.reserveFileID
 	cd.Limiter = lc.kv.limiter
+	cd.DisableDirectIO = lc.kv.opt.DisableDirectIO
+	cd.RetainLatestVersionOnly = lc.kv.opt.RetainLatestVersionOnly
 }
 
 func (lc *levelsController) getCompactor(cd *CompactDef) compactor {
-	if len(cd.SkippedTbls) > 0 || lc.kv.opt.RemoteCompactionAddr == "" || lc.kv.opt.ValueThreshold > 0 {
+	allAddrs := lc.kv.opt.RemoteCompactionAddrs
+	if len(cd.SkippedTbls) > 0 || len(allAddrs) == 0 || lc.kv.opt.ValueThreshold > 0 {
 		return &localCompactor{}
 	}
+	// Start from the next address in round-robin, the rest are used for failover.
+	start := int(atomic.AddUint32(&lc.nextRemoteAddr, 1))
+	addrs := make([]string, len(allAddrs))
+	for i := range addrs {
+		addrs[i] = allAddrs[(start+i)%len(allAddrs)]
+	}
 	return &remoteCompactor{
-		remoteAddr: lc.kv.opt.RemoteCompactionAddr,
+		remoteAddrs: addrs,
 	}
 }
 
@@ -390,9 +417,17 @@ func (lc *levelsController) compactBuildTables(cd *CompactDef) (newTables []tabl
 	// Try to collect stats so that we can inform value log about GC. That would help us find which
 	// value log file should be GCed.
 	lc.prepareCompactionDef(cd)
+	if err = validateGuards(cd.Guards); err != nil {
+		return nil, err
+	}
 	stats := &y.CompactionStats{}
 	discardStats := &DiscardStats{}
 	buildResults, err := lc.getCompactor(cd).compact(cd, stats, discardStats)
+	if ff, ok := cd.Filter.(FinalizeFilter); ok {
+		if ferr := ff.Finalize(); err == nil {
+			err = ferr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -404,6 +439,13 @@ func (lc *levelsController) compactBuildTables(cd *CompactDef) (newTables []tabl
 	return
 }
 
+func (cd *CompactDef) filter(key y.Key, vs y.ValueStruct) Decision {
+	if vf, ok := cd.Filter.(VersionedFilter); ok {
+		return vf.FilterWithVersion(key.UserKey, vs.Value, vs.UserMeta, key.Version)
+	}
+	return cd.Filter.Filter(key.UserKey, vs.Value, vs.UserMeta)
+}
+
 // CompactTables compacts tables in CompactDef and returns the file names.
 func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *DiscardStats) ([]*sstable.BuildResult, error) {
 	var buildResults []*sstable.BuildResult
@@ -415,13 +457,14 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 
 	var lastKey, skipKey y.Key
 	var builder *sstable.Builder
+	dynamicGuard, _ := cd.Filter.(DynamicGuardFilter)
 	for it.Valid() {
 		var fd *os.File
 		if !cd.InMemory {
 			fileID := cd.AllocIDFunc()
 			filename := sstable.NewFilename(fileID, cd.Dir)
 			var err error
-			fd, err = directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+			fd, err = fileutil.OpenDirectFile(filename, os.O_CREATE|os.O_RDWR, 0666, cd.DisableDirectIO)
 			if err != nil {
 				return nil, err
 			}
@@ -433,6 +476,7 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 		}
 		lastKey.Reset()
 		guard := searchGuard(it.Key().UserKey, cd.Guards)
+		var dynamicGuardHit bool
 		for ; it.Valid(); y.NextAllVersion(it) {
 			stats.KeysRead++
 			vs := it.Value()
@@ -462,6 +506,9 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 				if shouldFinishFile(key, lastKey, guard, int64(builder.EstimateSize()+kvSize), cd.Opt.MaxTableSize) {
 					break
 				}
+				if dynamicGuardHit && (guard == nil || int64(builder.EstimateSize()) >= guard.MinSize) {
+					break
+				}
 				if len(splitHints) != 0 && key.Compare(splitHints[0]) >= 0 {
 					splitHints = splitHints[1:]
 					for len(splitHints) > 0 && key.Compare(splitHints[0]) >= 0 {
@@ -486,7 +533,7 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 						continue
 					}
 				} else if cd.Filter != nil {
-					switch cd.Filter.Filter(key.UserKey, vs.Value, vs.UserMeta) {
+					switch cd.filter(key, vs) {
 					case DecisionMarkTombstone:
 						discardStats.collect(vs)
 						if cd.HasOverlap {
@@ -497,13 +544,24 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 					case DecisionDrop:
 						discardStats.collect(vs)
 						continue
+					case DecisionRewrite:
+						if rf, ok := cd.Filter.(RewriteFilter); ok && vs.Meta&bitValuePointer == 0 {
+							vs.Value = rf.Rewrite(key.UserKey, vs.Value, vs.UserMeta)
+							kvSize = int(vs.EncodedSize()) + key.Len()
+						}
 					case DecisionKeep:
 					}
 				}
+			} else if cd.RetainLatestVersionOnly {
+				// The older versions are discarded even if they may be read by a running transaction.
+				skipKey.Copy(key)
 			}
 			builder.Add(key, vs)
 			stats.KeysWrite++
 			stats.BytesWrite += kvSize
+			if dynamicGuard != nil && dynamicGuard.DynamicGuard(key.UserKey) {
+				dynamicGuardHit = true
+			}
 		}
 		if builder.Empty() {
 			continue
@@ -621,6 +679,9 @@ func (lc *levelsController) runCompactDef(cd *CompactDef, guard *epoch.Guard) er
 	// we access levels when reading.
 	nextLevel.replaceTables(newTables, cd, guard)
 	thisLevel.deleteTables(cd.Top, guard, cd.moveDown())
+	if cd.Level == 0 {
+		lc.updateLevelZeroMetrics()
+	}
 
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
@@ -720,6 +781,10 @@ func (lc *levelsController) addLevel0Table(t table.Table, head *protos.HeadInfo)
 	return nil
 }
 
+func (lc *levelsController) updateLevelZeroMetrics() {
+	lc.kv.metrics.NumLevelZeroTables.Set(float64(lc.levels[0].numTables()))
+}
+
 func (s *levelsController) close() error {
 	err := s.cleanupLevels()
 	return errors.Wrap(err, "levelsController.Close")
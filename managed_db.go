@@ -71,3 +71,22 @@ func (txn *Txn) CommitAt(commitTs uint64) error {
 	txn.commitTs = commitTs
 	return txn.Commit()
 }
+
+// MaxCommitTs returns the commit timestamp watermark, which is the largest commit timestamp
+// committed or set by SetCommitTs. It's stored in the head info of the manifest when a memtable
+// is flushed and restored when the DB is opened.
+func (db *DB) MaxCommitTs() uint64 {
+	return db.orc.maxCommitTs()
+}
+
+// SetCommitTs sets the commit timestamp watermark of a managed DB, so it can be aligned with
+// an external timestamp oracle. The watermark can only move forward.
+func (db *DB) SetCommitTs(ts uint64) error {
+	if !db.IsManaged() {
+		return ErrInvalidRequest
+	}
+	if !db.orc.setCommitTs(ts) {
+		return ErrCommitTsGoBack
+	}
+	return nil
+}
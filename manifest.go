@@ -320,10 +320,6 @@ func (r *countingReader) ReadByte() (b byte, err error) {
 	return
 }
 
-var (
-	errBadMagic = errors.New("manifest has bad magic")
-)
-
 // ReplayManifestFile reads the manifest file and constructs two manifest objects.  (We need one
 // immutable copy and one mutable copy of the manifest.  Easiest way is to construct two of them.)
 // Also, returns the last offset after a completely read manifest entry -- the file must be
@@ -334,10 +330,10 @@ func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error
 
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(&r, magicBuf[:]); err != nil {
-		return Manifest{}, 0, errBadMagic
+		return Manifest{}, 0, errors.Wrap(ErrManifestCorrupt, "manifest has bad magic")
 	}
 	if !bytes.Equal(magicBuf[0:4], magicText[:]) {
-		return Manifest{}, 0, errBadMagic
+		return Manifest{}, 0, errors.Wrap(ErrManifestCorrupt, "manifest has bad magic")
 	}
 	version := binary.BigEndian.Uint32(magicBuf[4:8])
 	if version != magicVersion {
@@ -371,11 +367,11 @@ func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error
 
 		var changeSet protos.ManifestChangeSet
 		if err := changeSet.Unmarshal(buf); err != nil {
-			return Manifest{}, 0, err
+			return Manifest{}, 0, errors.Wrap(ErrManifestCorrupt, err.Error())
 		}
 
 		if err := applyChangeSet(&build, &changeSet); err != nil {
-			return Manifest{}, 0, err
+			return Manifest{}, 0, errors.Wrap(ErrManifestCorrupt, err.Error())
 		}
 	}
 
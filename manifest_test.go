@@ -31,6 +31,7 @@ import (
 	"github.com/pingcap/badger/protos"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -80,7 +81,7 @@ func TestManifestBasic(t *testing.T) {
 	require.NoError(t, kv.Close())
 }
 
-func helpTestManifestFileCorruption(t *testing.T, off int64, errorContent string) {
+func helpTestManifestFileCorruption(t *testing.T, off int64, errorContent string) error {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
@@ -105,10 +106,12 @@ func helpTestManifestFileCorruption(t *testing.T, off int64, errorContent string
 	}()
 	require.Error(t, err)
 	require.Contains(t, err.Error(), errorContent)
+	return err
 }
 
 func TestManifestMagic(t *testing.T) {
-	helpTestManifestFileCorruption(t, 3, "bad magic")
+	err := helpTestManifestFileCorruption(t, 3, "bad magic")
+	require.Equal(t, ErrManifestCorrupt, errors.Cause(err))
 }
 
 func TestManifestVersion(t *testing.T) {
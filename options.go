@@ -63,6 +63,13 @@ type Options struct {
 	MaxBlockCacheSize int64
 	MaxIndexCacheSize int64
 
+	// BlockCacheMemFraction and IndexCacheMemFraction set the cache sizes as a fraction of the total
+	// system memory, they must be within [0, 1]. A fraction is only applied if the corresponding
+	// absolute size is 0, so the size must be cleared to use it. The total memory is only detected on
+	// Linux, Open fails on other platforms if a fraction is applied.
+	BlockCacheMemFraction float64
+	IndexCacheMemFraction float64
+
 	// Maximum total size for L1.
 	LevelOneSize int64
 
@@ -79,6 +86,11 @@ type Options struct {
 	// Number of compaction workers to run concurrently.
 	NumCompactors int
 
+	// Capacity of the write channel. The write worker takes all the pending requests in the channel
+	// as one batch, so a larger capacity allows bigger batches, a smaller one blocks writers sooner.
+	// It must not be negative.
+	WriteChannelCapacity int
+
 	// Transaction start and commit timestamps are managed by end-user.
 	// A managed transaction can only set values by SetEntry with a non-zero version key.
 	ManagedTxns bool
@@ -100,6 +112,14 @@ type Options struct {
 	// Truncate value log to delete corrupt data, if any. Would not truncate if ReadOnly is set.
 	Truncate bool
 
+	// Write SST and blob files without O_DIRECT. Direct IO is also skipped
+	// if the file system doesn't support it.
+	DisableDirectIO bool
+
+	// Limits the write throughput of memtable flush in bytes per second. If it's not positive,
+	// flush shares the limiter of TableBuilderOptions.BytesPerSecond with compaction.
+	FlushBytesPerSecond int
+
 	TableBuilderOptions options.TableBuilderOptions
 
 	ValueLogWriteOptions options.ValueLogWriterOptions
@@ -108,7 +128,25 @@ type Options struct {
 
 	CompactL0WhenClose bool
 
+	// TargetFileSizeByLevel is the size of the sstables built by compaction for each level, indexed
+	// by the output level. TableBuilderOptions.MaxTableSize is used for a level if it's not set.
+	TargetFileSizeByLevel []int64
+
+	// RetainLatestVersionOnly makes compaction keep only the latest version of each key, older
+	// versions are discarded regardless of the safe ts, so snapshots of older versions may be lost.
+	RetainLatestVersionOnly bool
+
+	// CommitObserver is called for every committed entry after it is written to the memtable, in
+	// commit order. It's called by the single write goroutine, so a slow observer slows down all
+	// writes. The entry must not be modified or retained. Entries replayed on Open are not observed.
+	CommitObserver func(e *Entry)
+
 	RemoteCompactionAddr string
+
+	// Addresses of remote compaction workers. Compactions are dispatched to them in round-robin,
+	// if a worker can't be connected the next one is tried, and if none of them can be connected,
+	// the compaction is done locally. RemoteCompactionAddr is used as the first one if set.
+	RemoteCompactionAddrs []string
 }
 
 // CompactionFilter is an interface that user can implement to remove certain keys.
@@ -122,6 +160,33 @@ type CompactionFilter interface {
 	Guards() []Guard
 }
 
+// RewriteFilter is an optional interface that a CompactionFilter can implement to rewrite values.
+type RewriteFilter interface {
+	// Rewrite is invoked for the kv which Filter returns DecisionRewrite, the returned value replaces the
+	// original value in the output of this compaction run. Values stored in blob files are not rewritten.
+	Rewrite(key, val, userMeta []byte) []byte
+}
+
+// VersionedFilter is an optional interface that a CompactionFilter can implement to make decisions
+// by the version of the kv. If implemented, FilterWithVersion is invoked instead of Filter.
+type VersionedFilter interface {
+	FilterWithVersion(key, val, userMeta []byte, version uint64) Decision
+}
+
+// DynamicGuardFilter is an optional interface that a CompactionFilter can implement to finish SST files
+// dynamically. DynamicGuard is invoked for every kept key, if it returns true, the SST is finished after
+// the key once the MinSize of the matched Guard is reached.
+type DynamicGuardFilter interface {
+	DynamicGuard(key []byte) bool
+}
+
+// FinalizeFilter is an optional interface that a CompactionFilter can implement to flush accumulated
+// state or report stats. Finalize is invoked once when the compaction run completes, after the last
+// call of Filter. A returned error fails the compaction.
+type FinalizeFilter interface {
+	Finalize() error
+}
+
 // Guard specifies when to finish a SST file during compaction. The rule is the following:
 // 1. The key must match the Prefix of the Guard, otherwise the SST should finish.
 // 2. If the key up to MatchLen is the different than the previous key and MinSize is reached, the SST should finish.
@@ -141,6 +206,9 @@ const (
 	DecisionMarkTombstone Decision = 1
 	// DecisionDrop simply drops the entry, doesn't leave a delete tombstone.
 	DecisionDrop Decision = 2
+	// DecisionRewrite replaces the value of the entry by the result of RewriteFilter.Rewrite.
+	// If the filter doesn't implement RewriteFilter, the entry is kept unchanged.
+	DecisionRewrite Decision = 3
 )
 
 // DefaultOptions sets a list of recommended options for good performance.
@@ -150,6 +218,7 @@ var DefaultOptions = Options{
 	LevelOneSize:            256 << 20,
 	MaxMemTableSize:         64 << 20,
 	NumCompactors:           3,
+	WriteChannelCapacity:    1000,
 	NumLevelZeroTables:      5,
 	NumLevelZeroTablesStall: 10,
 	NumMemtables:            5,
@@ -159,6 +228,7 @@ var DefaultOptions = Options{
 	ValueLogMaxNumFiles:     1,
 	ValueThreshold:          32,
 	Truncate:                false,
+	FlushBytesPerSecond:     -1,
 	MaxBlockCacheSize:       1 << 30,
 	MaxIndexCacheSize:       1 << 30,
 	TableBuilderOptions: options.TableBuilderOptions{
@@ -196,3 +266,10 @@ func init() {
 	LSMOnlyOptions.ValueThreshold = 65500      // Max value length which fits in uint16.
 	LSMOnlyOptions.ValueLogFileSize = 64 << 20 // Allow easy space reclamation.
 }
+
+func (opt *Options) targetFileSize(level int) int64 {
+	if level < len(opt.TargetFileSizeByLevel) && opt.TargetFileSizeByLevel[level] > 0 {
+		return opt.TargetFileSizeByLevel[level]
+	}
+	return opt.TableBuilderOptions.MaxTableSize
+}
@@ -67,6 +67,11 @@ func (e *Entry) SetDelete() {
 	e.meta |= bitDelete
 }
 
+// IsDeleted returns true if the entry is a delete tombstone.
+func (e *Entry) IsDeleted() bool {
+	return isDeleted(e.meta)
+}
+
 func (e *Entry) estimateSize() int {
 	return e.Key.Len() + len(e.Value) + len(e.UserMeta) + 2 // Meta, UserMeta
 }
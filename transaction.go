@@ -118,6 +118,42 @@ func (o *oracle) newCommitTs(txn *Txn) uint64 {
 	return ts
 }
 
+// maxCommitTs returns the largest commit ts that has been allocated or set.
+func (o *oracle) maxCommitTs() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	return o.nextCommit - 1
+}
+
+// headTs returns the ts stored in the head info when a memtable is flushed, it's restored as the
+// read ts when the DB is opened. A managed DB stores its watermark so it's kept across restarts.
+func (o *oracle) headTs() uint64 {
+	if o.isManaged {
+		return o.maxCommitTs()
+	}
+	return o.commitTs()
+}
+
+// setCommitTs moves the commit ts forward, it returns false if ts is smaller than the current one.
+func (o *oracle) setCommitTs(ts uint64) bool {
+	o.Lock()
+	defer o.Unlock()
+	if ts < o.nextCommit-1 {
+		return false
+	}
+	o.nextCommit = ts + 1
+	return true
+}
+
+// advanceCommitTs moves the commit ts forward to ts if it's larger than the current one.
+func (o *oracle) advanceCommitTs(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if ts >= o.nextCommit {
+		o.nextCommit = ts + 1
+	}
+}
+
 func (o *oracle) allocTs() uint64 {
 	o.Lock()
 	ts := o.nextCommit
@@ -515,6 +551,9 @@ func (txn *Txn) Commit() error {
 	}
 
 	req.Wait()
+	if managed {
+		state.advanceCommitTs(txn.commitTs)
+	}
 	state.doneCommit(commitTs)
 
 	return nil
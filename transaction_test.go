@@ -927,3 +927,91 @@ func TestMangedDB(t *testing.T) {
 	})
 	require.Nil(t, err)
 }
+
+func TestSetCommitTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SetCommitTs(100))
+	require.Equal(t, uint64(100), db.MaxCommitTs())
+	require.Equal(t, ErrCommitTsGoBack, db.SetCommitTs(99))
+	require.Equal(t, uint64(100), db.MaxCommitTs())
+	require.NoError(t, db.SetCommitTs(200))
+
+	txn := db.NewTransactionAt(150, true)
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte("k"), 150), Value: []byte("v")}))
+	require.NoError(t, txn.CommitAt(150))
+	require.NoError(t, db.Close())
+
+	// The flushed memtable records the commit ts in the manifest head.
+	mf, manifest, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, mf.close())
+	require.NotNil(t, manifest.Head)
+	require.Equal(t, uint64(200), manifest.Head.Version)
+
+	// The watermark doesn't move forward across restarts.
+	db, err = OpenManaged(opts)
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), db.MaxCommitTs())
+	require.NoError(t, db.SetCommitTs(200))
+	require.Equal(t, ErrCommitTsGoBack, db.SetCommitTs(199))
+	require.NoError(t, db.Close())
+	db, err = OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, uint64(200), db.MaxCommitTs())
+
+	// Committing above the watermark moves it forward.
+	txn = db.NewTransactionAt(500, true)
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte("k"), 500), Value: []byte("v")}))
+	require.NoError(t, txn.CommitAt(500))
+	require.Equal(t, uint64(500), db.MaxCommitTs())
+	require.Equal(t, ErrCommitTsGoBack, db.SetCommitTs(499))
+}
+
+func TestSafeTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	db, err := OpenManaged(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := []byte("k")
+	for _, version := range []uint64{10, 20, 30} {
+		txn := db.NewTransactionAt(version, true)
+		require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs(key, version), Value: []byte("v")}))
+		require.NoError(t, txn.CommitAt(version))
+	}
+	db.UpdateSafeTs(25)
+	require.Equal(t, uint64(25), db.SafeTs())
+	// The safe ts never goes back.
+	db.UpdateSafeTs(5)
+	require.Equal(t, uint64(25), db.SafeTs())
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.CompactL0())
+	get := func(readTs uint64) (uint64, error) {
+		txn := db.NewTransactionAt(readTs, false)
+		defer txn.Discard()
+		item, err := txn.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		return item.Version(), nil
+	}
+	// Version 10 is discarded, since version 20 is the latest one below the safe ts.
+	_, err = get(15)
+	require.Equal(t, ErrKeyNotFound, err)
+	version, err := get(25)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), version)
+	version, err = get(math.MaxUint64)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), version)
+}
@@ -527,18 +527,20 @@ func (vlog *valueLog) flush() error {
 
 	if vlog.writableOffset() > uint32(vlog.opt.ValueLogFileSize) ||
 		vlog.numEntriesWritten > vlog.opt.ValueLogMaxEntries {
-		var err error
-		if err = curlf.doneWriting(vlog.writableOffset()); err != nil {
-			return err
-		}
-		err = vlog.createVlogFile(vlog.maxFid() + 1)
-		if err != nil {
-			return err
-		}
+		return vlog.rotate()
 	}
 	return nil
 }
 
+// rotate finishes the current log file and starts writing to a new one. It must be called after
+// flush by the write goroutine.
+func (vlog *valueLog) rotate() error {
+	if err := vlog.currentLogFile().doneWriting(vlog.writableOffset()); err != nil {
+		return err
+	}
+	return vlog.createVlogFile(vlog.maxFid() + 1)
+}
+
 // write is thread-unsafe by design and should not be called concurrently.
 func (vlog *valueLog) write(reqs []*request) error {
 	for i := range reqs {
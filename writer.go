@@ -19,6 +19,7 @@ package badger
 import (
 	"os"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/pingcap/badger/epoch"
@@ -42,8 +43,22 @@ type mergeLSMTask struct {
 }
 
 type postLogTask struct {
-	logFile *os.File
-	reqs    []*request
+	logFile    *os.File
+	reqs       []*request
+	forceFlush *forceFlushTask
+	synced     *sync.WaitGroup // Done by the flusher when the log file is synced.
+}
+
+type forceFlushTask struct {
+	sync.WaitGroup
+	flushed *sync.WaitGroup // Done when the memtables are flushed.
+	err     error
+}
+
+type rotateVLogTask struct {
+	sync.WaitGroup
+	fid uint32 // The fid of the new log file.
+	err error
 }
 
 func startWriteWorker(db *DB) *y.Closer {
@@ -75,8 +90,15 @@ func (w *writeWorker) runFlusher(lc *y.Closer) {
 			start := time.Now()
 			err := fileutil.Fdatasync(t.logFile)
 			w.metrics.VlogSyncDuration.Observe(time.Since(start).Seconds())
+			if t.synced != nil {
+				t.synced.Done()
+			}
 			if err != nil {
 				w.done(t.reqs, err)
+				if t.forceFlush != nil {
+					t.forceFlush.err = err
+					t.forceFlush.Done()
+				}
 				continue
 			}
 			w.writeLSMCh <- t
@@ -94,11 +116,25 @@ func (w *writeWorker) runWriteVLog(lc *y.Closer) {
 		select {
 		case task := <-w.ingestCh:
 			w.ingestTables(task)
+		case task := <-w.forceFlushCh:
+			// Write the pending requests first, so they are included in the flushed memtable.
+			reqs := w.pollWriteCh(make([]*request, len(w.writeCh)))
+			if err := w.writeVLog(reqs, task); err != nil {
+				task.err = err
+				task.Done()
+				return
+			}
+		case task := <-w.rotateVLogCh:
+			// Write the pending requests first, so they are included in the finished log file.
+			reqs := w.pollWriteCh(make([]*request, len(w.writeCh)))
+			if err := w.rotateVLog(reqs, task); err != nil {
+				return
+			}
 		case r = <-w.writeCh:
 			reqs := make([]*request, len(w.writeCh)+1)
 			reqs[0] = r
 			w.pollWriteCh(reqs[1:])
-			if err := w.writeVLog(reqs); err != nil {
+			if err := w.writeVLog(reqs, nil); err != nil {
 				return
 			}
 		case <-lc.HasBeenClosed():
@@ -115,22 +151,53 @@ func (w *writeWorker) pollWriteCh(buf []*request) []*request {
 	return buf
 }
 
-func (w *writeWorker) writeVLog(reqs []*request) error {
+func (w *writeWorker) writeVLog(reqs []*request, forceFlush *forceFlushTask) error {
 	if !w.volatileMode {
 		if err := w.vlog.write(reqs); err != nil {
 			w.done(reqs, err)
 			return err
 		}
 	}
+	t := postLogTask{
+		logFile:    w.vlog.currentLogFile().fd,
+		reqs:       reqs,
+		forceFlush: forceFlush,
+	}
+	if w.opt.SyncWrites && !w.volatileMode {
+		w.flushCh <- t
+	} else {
+		w.writeLSMCh <- t
+	}
+	return nil
+}
+
+// rotateVLog writes the requests to the current log file, then rotates it. With SyncWrites the
+// flusher syncs the file asynchronously, so we wait until the requests are synced before the file
+// is closed by the rotation.
+func (w *writeWorker) rotateVLog(reqs []*request, task *rotateVLogTask) error {
+	defer task.Done()
+	if err := w.vlog.write(reqs); err != nil {
+		w.done(reqs, err)
+		task.err = err
+		return err
+	}
 	t := postLogTask{
 		logFile: w.vlog.currentLogFile().fd,
 		reqs:    reqs,
 	}
-	if w.opt.SyncWrites && !w.volatileMode {
+	if w.opt.SyncWrites {
+		var synced sync.WaitGroup
+		synced.Add(1)
+		t.synced = &synced
 		w.flushCh <- t
+		synced.Wait()
 	} else {
 		w.writeLSMCh <- t
 	}
+	if task.err = w.vlog.rotate(); task.err != nil {
+		return task.err
+	}
+	task.fid = w.vlog.maxFid()
 	return nil
 }
 
@@ -146,6 +213,9 @@ func (w *writeWorker) runWriteLSM(lc *y.Closer) {
 		start := time.Now()
 		w.writeLSM(t.reqs)
 		w.metrics.WriteLSMDuration.Observe(time.Since(start).Seconds())
+		if t.forceFlush != nil {
+			w.forceFlushMemTable(t.forceFlush)
+		}
 	}
 }
 
@@ -203,6 +273,21 @@ func (w *writeWorker) writeLSM(reqs []*request) {
 	return
 }
 
+// forceFlushMemTable is called serially by the writeLSM goroutine.
+func (w *writeWorker) forceFlushMemTable(task *forceFlushTask) {
+	defer task.Done()
+	mTbls := w.mtbls.Load().(*memTables)
+	if !mTbls.getMutable().Empty() {
+		task.flushed = w.flushMemTable()
+		return
+	}
+	// Nothing to flush in the mutable memtable, wait for the immutable memtables.
+	ft := &flushTask{barrier: true}
+	ft.wg.Add(1)
+	w.flushChan <- ft
+	task.flushed = &ft.wg
+}
+
 func (w *writeWorker) done(reqs []*request, err error) {
 	for _, r := range reqs {
 		r.Err = err
@@ -250,6 +335,7 @@ func (w *writeWorker) writeToLSM(entries []*Entry) error {
 			es = append(es, e)
 		}
 		w.updateOffset(entries[i-1].logOffset)
+		written := entries[:i]
 		entries = entries[i:]
 
 		mTbls.getMutable().PutToPendingList(es)
@@ -257,6 +343,13 @@ func (w *writeWorker) writeToLSM(entries []*Entry) error {
 			mt:    mTbls.getMutable(),
 			guard: w.resourceMgr.Acquire(),
 		}
+		if w.opt.CommitObserver != nil {
+			for _, entry := range written {
+				if entry.meta&bitFinTxn == 0 {
+					w.opt.CommitObserver(entry)
+				}
+			}
+		}
 	}
 
 	return nil
@@ -63,7 +63,7 @@ func (w *writeWorker) prepareIngestTask(task *ingestTask) (ts uint64, wg *sync.W
 	reqs := w.pollWriteCh(make([]*request, len(w.writeCh)))
 	w.orc.writeLock.Unlock()
 
-	if err = w.writeVLog(reqs); err != nil {
+	if err = w.writeVLog(reqs, nil); err != nil {
 		return 0, nil, err
 	}
 
@@ -138,6 +138,9 @@ func (w *writeWorker) ingestTable(tbl *sstable.Table, splitHints []y.Key) error
 		return err
 	}
 	w.lc.levels[targetLevel].addTable(tbl)
+	if targetLevel == 0 {
+		w.lc.updateLevelZeroMetrics()
+	}
 	return nil
 }
 
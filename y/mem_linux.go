@@ -0,0 +1,14 @@
+// +build linux
+
+package y
+
+import "golang.org/x/sys/unix"
+
+// TotalMemory returns the total physical memory of the system in bytes.
+func TotalMemory() (uint64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	return uint64(info.Totalram) * uint64(info.Unit), nil
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package y
+
+import "github.com/pingcap/errors"
+
+// TotalMemory returns the total physical memory of the system in bytes.
+func TotalMemory() (uint64, error) {
+	return 0, errors.New("detecting total memory is not supported on this platform")
+}
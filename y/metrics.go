@@ -75,6 +75,22 @@ var (
 		Namespace: namespace,
 		Name:      "num_memtable_gets",
 	}, []string{labelPath})
+	// NumMemtableSwitches is number of times the mutable memtable is switched for flushing
+	NumMemtableSwitches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "num_memtable_switches",
+	}, []string{labelPath})
+
+	// FlushQueueLength has number of memtables waiting to be flushed
+	FlushQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "flush_queue_length",
+	}, []string{labelPath})
+	// NumLevelZeroTables has number of tables in level 0
+	NumLevelZeroTables = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "num_level_zero_tables",
+	}, []string{labelPath})
 
 	// Level statistics
 
@@ -157,6 +173,9 @@ type MetricsSet struct {
 	NumGets             prometheus.Counter
 	NumPuts             prometheus.Counter
 	NumMemtableGets     prometheus.Counter
+	NumMemtableSwitches prometheus.Counter
+	FlushQueueLength    prometheus.Gauge
+	NumLevelZeroTables  prometheus.Gauge
 	VlogSyncDuration    prometheus.Observer
 	WriteLSMDuration    prometheus.Observer
 	LSMGetDuration      prometheus.Observer
@@ -176,6 +195,9 @@ func NewMetricSet(path string) *MetricsSet {
 		NumGets:             NumGets.WithLabelValues(path),
 		NumPuts:             NumPuts.WithLabelValues(path),
 		NumMemtableGets:     NumMemtableGets.WithLabelValues(path),
+		NumMemtableSwitches: NumMemtableSwitches.WithLabelValues(path),
+		FlushQueueLength:    FlushQueueLength.WithLabelValues(path),
+		NumLevelZeroTables:  NumLevelZeroTables.WithLabelValues(path),
 		VlogSyncDuration:    VlogSyncDuration.WithLabelValues(path),
 		WriteLSMDuration:    WriteLSMDuration.WithLabelValues(path),
 		LSMGetDuration:      LSMGetDuration.WithLabelValues(path),
@@ -242,6 +264,9 @@ func init() {
 	prometheus.MustRegister(NumGets)
 	prometheus.MustRegister(NumPuts)
 	prometheus.MustRegister(NumMemtableGets)
+	prometheus.MustRegister(NumMemtableSwitches)
+	prometheus.MustRegister(FlushQueueLength)
+	prometheus.MustRegister(NumLevelZeroTables)
 	prometheus.MustRegister(VlogSyncDuration)
 	prometheus.MustRegister(WriteLSMDuration)
 	prometheus.MustRegister(LSMGetDuration)